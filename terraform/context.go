@@ -8,13 +8,42 @@ import (
 	"sync/atomic"
 
 	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/depgraph"
 	"github.com/hashicorp/terraform/helper/multierror"
+	"github.com/hashicorp/terraform/tfdiags"
 )
 
 // This is a function type used to implement a walker for the resource
-// tree internally on the Terraform structure.
-type genericWalkFunc func(*Resource) (map[string]string, error)
+// tree internally on the Terraform structure. Unlike earlier versions,
+// this no longer returns newly discovered variables: a node's variables
+// are instead computed on demand from the current State at the point of
+// interpolation, so there is nothing left for a callback to report back.
+type genericWalkFunc func(*Resource) error
+
+// DefaultParallelism is the default limit on concurrent walk operations
+// if ContextOpts.Parallelism is left unset.
+const DefaultParallelism = 10
+
+// InputMode defines what sort of input will be asked for when Context.Input
+// is called.
+type InputMode byte
+
+const (
+	// InputModeVar asks for all variables
+	InputModeVar InputMode = 1 << iota
+
+	// InputModeVarUnset asks for variables which are not set yet.
+	// InputModeVar must be set for this to have an effect.
+	InputModeVarUnset
+
+	// InputModeProvider asks for provider variables
+	InputModeProvider
+
+	// InputModeStd is the standard operating mode and asks for both
+	// variables and providers.
+	InputModeStd = InputModeVar | InputModeVarUnset | InputModeProvider
+)
 
 // Context represents all the context that Terraform needs in order to
 // perform operations on infrastructure. This structure is built using
@@ -22,27 +51,88 @@ type genericWalkFunc func(*Resource) (map[string]string, error)
 //
 // Additionally, a context can be created from a Plan using Plan.Context.
 type Context struct {
-	config    *config.Config
-	diff      *Diff
-	hooks     []Hook
-	state     *State
-	providers map[string]ResourceProviderFactory
-	variables map[string]string
+	module *module.Tree
+	config *config.Config
+
+	// path is the module path this Context is scoped to, as returned by
+	// Module. A nil path means the root module. It is nil for every
+	// Context created directly by NewContext.
+	path []string
+
+	diff         *Diff
+	hooks        []Hook
+	providers    map[string]ResourceProviderFactory
+	provisioners map[string]ResourceProvisionerFactory
+	variables    map[string]string
+	parallelSem  Semaphore
+	uiInput      UIInput
+
+	// state is the live, in-progress state for the current (or most
+	// recent) operation. It is deep-copied at the start of Apply, Plan
+	// and Refresh so that it becomes the authoritative, mutable result:
+	// walk callbacks update it directly instead of threading a separate
+	// result value through the graph walk. sl guards all access to it.
+	//
+	// sl is a pointer, shared with every Context returned by Module,
+	// because a module-scoped Context starts out reading and writing the
+	// very same underlying Resources/Modules maps as the root Context it
+	// was derived from (resourcesIn and moduleResourceStore address into
+	// path within a shared tree, not a private copy). A module-scoped
+	// Context's own sync.RWMutex would not serialize against the
+	// root's, leaving State() free to race an Apply in progress on a
+	// sibling Context over the same maps. The maps stay shared only
+	// until either Context starts an Apply, Plan or Refresh: each of
+	// those replaces only its own receiver's state with a fresh deep
+	// copy, which the other Context does not see.
+	state *State
+	sl    *sync.RWMutex
+
+	// run holds the single-flight bookkeeping used by acquireRun and
+	// releaseRun. It is shared by pointer with every Context returned
+	// by Module, so that a root Context and a module-scoped Context
+	// derived from it still serialize against each other instead of
+	// running concurrently.
+	run *contextRunState
+	sh  *stopHook
+}
 
+// contextRunState is the single-flight state shared between a Context
+// and every Context derived from it via Module.
+type contextRunState struct {
 	l     sync.Mutex
 	runCh <-chan struct{}
-	sh    *stopHook
 }
 
 // ContextOpts are the user-creatable configuration structure to create
 // a context with NewContext.
 type ContextOpts struct {
-	Config    *config.Config
-	Diff      *Diff
-	Hooks     []Hook
-	State     *State
-	Providers map[string]ResourceProviderFactory
-	Variables map[string]string
+	// Module is the root of the configuration's module tree: the root
+	// module's own configuration plus every module it (transitively)
+	// calls, already loaded. A Context walks this whole tree, not just
+	// the root module's resources, prefixing the id of any resource in
+	// a descendant module with its module path (for example
+	// "module.vpc.aws_instance.web").
+	Module *module.Tree
+
+	Diff         *Diff
+	Hooks        []Hook
+	State        *State
+	Providers    map[string]ResourceProviderFactory
+	Provisioners map[string]ResourceProvisionerFactory
+	Variables    map[string]string
+
+	// UIInput is used to prompt the user for values that are missing
+	// from configuration (unset variables, required provider config)
+	// when Input is called. If this is nil, Input will error for any
+	// value it needs to prompt for.
+	UIInput UIInput
+
+	// Parallelism bounds the number of concurrent walk callbacks (resource
+	// applies, diffs, and refreshes) that are allowed to be in-flight at
+	// once. This protects provider APIs that rate-limit and keeps large
+	// graphs from fanning out unboundedly. The zero value defaults to
+	// DefaultParallelism; a negative value removes the limit entirely.
+	Parallelism int
 }
 
 // NewContext creates a new context.
@@ -59,15 +149,100 @@ func NewContext(opts *ContextOpts) *Context {
 	copy(hooks, opts.Hooks)
 	hooks[len(opts.Hooks)] = sh
 
+	// A zero Parallelism means "use the default"; negative means
+	// "no limit", so we leave parallelSem nil and the walk skips it.
+	var sem Semaphore
+	switch {
+	case opts.Parallelism == 0:
+		sem = NewSemaphore(DefaultParallelism)
+	case opts.Parallelism > 0:
+		sem = NewSemaphore(opts.Parallelism)
+	}
+
+	var rootConfig *config.Config
+	if opts.Module != nil {
+		rootConfig = opts.Module.Config()
+	}
+
 	return &Context{
-		config:    opts.Config,
-		diff:      opts.Diff,
-		hooks:     hooks,
-		state:     opts.State,
-		providers: opts.Providers,
-		variables: opts.Variables,
+		module:       opts.Module,
+		config:       rootConfig,
+		diff:         opts.Diff,
+		hooks:        hooks,
+		state:        opts.State,
+		sl:           new(sync.RWMutex),
+		providers:    opts.Providers,
+		provisioners: opts.Provisioners,
+		variables:    opts.Variables,
+		parallelSem:  sem,
+		uiInput:      opts.UIInput,
+
+		run: &contextRunState{},
+		sh:  sh,
+	}
+}
+
+// State returns a deep copy of the context's current state. This is safe
+// to call while an Apply or Refresh is in progress in another goroutine:
+// it always reflects a consistent snapshot of the resources that have
+// been updated so far, never a partially-written one.
+func (c *Context) State() *State {
+	c.sl.RLock()
+	defer c.sl.RUnlock()
+
+	return c.state.deepcopy()
+}
+
+// Module returns a Context scoped to the descendant module at path, a
+// sequence of module names relative to the root, for example
+// []string{"vpc"} for a top-level "module \"vpc\" {}" block, or
+// []string{"vpc", "subnets"} for a module nested within it. The
+// returned Context shares this Context's providers, provisioners,
+// hooks, and user variables, and its state is the same tree as the
+// receiver's holds at the time of the call: resourcesIn and computeVars
+// address into it using path, the same way they do for the whole-tree
+// walk a root Context performs, so a resource or module-output
+// reference from within path resolves correctly regardless of which
+// Context it is evaluated through. A later Apply, Plan or Refresh on
+// either Context replaces that Context's own state with a deep copy,
+// which the other Context does not see. It returns nil if no module is
+// loaded at path. An empty or nil path returns the receiver itself.
+func (c *Context) Module(path []string) *Context {
+	if len(path) == 0 {
+		return c
+	}
+
+	tree := c.module
+	for _, name := range path {
+		if tree == nil {
+			return nil
+		}
+		tree = tree.Children()[name]
+	}
+	if tree == nil {
+		return nil
+	}
 
-		sh: sh,
+	c.sl.RLock()
+	state := c.state
+	c.sl.RUnlock()
+
+	return &Context{
+		module:       tree,
+		config:       tree.Config(),
+		path:         append([]string(nil), path...),
+		diff:         c.diff,
+		hooks:        c.hooks,
+		providers:    c.providers,
+		provisioners: c.provisioners,
+		variables:    c.variables,
+		parallelSem:  c.parallelSem,
+		uiInput:      c.uiInput,
+		state:        state,
+		sl:           c.sl,
+
+		run: c.run,
+		sh:  c.sh,
 	}
 }
 
@@ -76,48 +251,164 @@ func NewContext(opts *ContextOpts) *Context {
 //
 // In addition to returning the resulting state, this context is updated
 // with the latest state.
-func (c *Context) Apply() (*State, error) {
+func (c *Context) Apply() (*State, tfdiags.Diagnostics) {
 	v := c.acquireRun()
 	defer c.releaseRun(v)
 
+	c.sl.RLock()
+	priorState := c.state
+	c.sl.RUnlock()
+
 	g, err := Graph(&GraphOpts{
-		Config:    c.config,
-		Diff:      c.diff,
-		Providers: c.providers,
-		State:     c.state,
+		Config:       c.config,
+		Module:       c.module,
+		Diff:         c.diff,
+		Providers:    c.providers,
+		Provisioners: c.provisioners,
+		State:        priorState,
 	})
 	if err != nil {
-		return nil, err
+		return nil, diagsFromErr(err)
 	}
 
-	// Create our result. Make sure we preserve the prior states
-	s := new(State)
-	s.init()
-	if c.state != nil {
-		for k, v := range c.state.Resources {
-			s.Resources[k] = v
-		}
+	// Deep-copy the prior state so that it becomes the authoritative,
+	// in-progress result. Walk callbacks mutate c.state directly from
+	// here on, guarded by c.sl.
+	c.sl.Lock()
+	s := c.state.deepcopy()
+	if s == nil {
+		s = new(State)
+		s.init()
 	}
+	c.state = s
+	c.sl.Unlock()
 
 	// Walk
-	err = g.Walk(c.applyWalkFn(s))
-
-	// Update our state, even if we have an error, for partial updates
-	c.state = s
+	diags := diagsFromErr(g.Walk(c.applyWalkFn()))
 
 	// If we have no errors, then calculate the outputs if we have any
-	if err == nil && len(c.config.Outputs) > 0 {
-		s.Outputs = make(map[string]string)
+	if !diags.HasErrors() && len(c.config.Outputs) > 0 {
+		c.sl.Lock()
+		c.state.Outputs = make(map[string]string)
 		for _, o := range c.config.Outputs {
-			if err = c.computeVars(s, o.RawConfig); err != nil {
+			if err := c.computeVars(c.state, nil, o.RawConfig); err != nil {
+				diags = diags.Append(tfdiags.Diagnostic{
+					Severity: tfdiags.Error,
+					Summary:  err.Error(),
+				})
 				break
 			}
 
-			s.Outputs[o.Name] = o.RawConfig.Config()["value"].(string)
+			c.state.Outputs[o.Name] = o.RawConfig.Config()["value"].(string)
 		}
+		c.sl.Unlock()
 	}
 
-	return s, err
+	return c.state, diags
+}
+
+// Input asks for input for the configured variables (with
+// InputModeVarUnset, only those that haven't already been supplied;
+// a variable with a default and no description is never asked for)
+// and, if InputModeProvider is set, asks each configured
+// provider for any input it requires. The result is merged into the
+// context's variables and raw provider configs so that it is picked
+// up the next time Plan or Apply builds the graph and configures
+// providers.
+func (c *Context) Input(mode InputMode) error {
+	v := c.acquireRun()
+	defer c.releaseRun(v)
+
+	if mode&InputModeVar != 0 {
+		for _, v := range c.config.Variables {
+			// If we only care about unset variables, then we should
+			// skip any variable that is already set.
+			if mode&InputModeVarUnset != 0 {
+				if _, ok := c.variables[v.Name]; ok {
+					continue
+				}
+			}
+
+			// If the variable isn't related to our interactive input, skip it.
+			if v.Description == "" && v.Default != nil {
+				continue
+			}
+
+			var defaultString string
+			if v.Default != nil {
+				defaultString = fmt.Sprintf("%v", v.Default)
+			}
+
+			if c.uiInput == nil {
+				return fmt.Errorf(
+					"Input asked for var.%s, but no UIInput given to ask with", v.Name)
+			}
+
+			value, err := c.uiInput.Input(&InputOpts{
+				Id:          fmt.Sprintf("var.%s", v.Name),
+				Query:       fmt.Sprintf("var.%s", v.Name),
+				Description: v.Description,
+				Default:     defaultString,
+			})
+			if err != nil {
+				return fmt.Errorf(
+					"Error asking for %s: %s", v.Name, err)
+			}
+
+			if c.variables == nil {
+				c.variables = make(map[string]string)
+			}
+			c.variables[v.Name] = value
+		}
+	}
+
+	if mode&InputModeProvider != 0 {
+		if c.uiInput == nil {
+			return fmt.Errorf(
+				"Input asked for provider configuration, but no UIInput given to ask with")
+		}
+
+		g, err := c.graph()
+		if err != nil {
+			return err
+		}
+
+		err = g.Walk(func(n *depgraph.Noun) error {
+			rn, ok := n.Meta.(*GraphNodeResourceProvider)
+			if !ok || rn.Config == nil {
+				return nil
+			}
+
+			rc := NewResourceConfig(rn.Config.RawConfig)
+
+			for k, p := range rn.Providers {
+				log.Printf("[INFO] Input for provider: %s", k)
+				newConfig, err := p.Input(c.uiInput, rc)
+				if err != nil {
+					return fmt.Errorf(
+						"Error configuring %s: %s", k, err)
+				}
+				if newConfig != nil {
+					rc = newConfig
+				}
+			}
+
+			// Replace the raw config with the (possibly augmented) result
+			// so that the values the provider asked for are picked up the
+			// next time Configure runs during Plan/Apply.
+			raw, err := config.NewRawConfig(rc.Config())
+			if err != nil {
+				return err
+			}
+			*rn.Config.RawConfig = *raw
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Plan generates an execution plan for the given context.
@@ -127,30 +418,52 @@ func (c *Context) Apply() (*State, error) {
 //
 // Plan also updates the diff of this context to be the diff generated
 // by the plan, so Apply can be called after.
-func (c *Context) Plan(opts *PlanOpts) (*Plan, error) {
+func (c *Context) Plan(opts *PlanOpts) (*Plan, tfdiags.Diagnostics) {
 	v := c.acquireRun()
 	defer c.releaseRun(v)
 
+	c.sl.RLock()
+	priorState := c.state
+	c.sl.RUnlock()
+
 	g, err := Graph(&GraphOpts{
-		Config:    c.config,
-		Providers: c.providers,
-		State:     c.state,
+		Config:       c.config,
+		Module:       c.module,
+		Providers:    c.providers,
+		Provisioners: c.provisioners,
+		State:        priorState,
 	})
 	if err != nil {
-		return nil, err
+		return nil, diagsFromErr(err)
 	}
 
+	// Deep-copy the prior state so that it becomes the authoritative,
+	// in-progress result, same as Apply and Refresh. Without this, a
+	// resource diffed later in the same walk that references an
+	// earlier one's attributes would resolve against stale, pre-diff
+	// data (or not find it at all for a newly-created resource), since
+	// computeVars now resolves references directly against c.state
+	// rather than a value threaded node-to-node through the walk.
+	c.sl.Lock()
+	s := c.state.deepcopy()
+	if s == nil {
+		s = new(State)
+		s.init()
+	}
+	c.state = s
+	c.sl.Unlock()
+
 	p := &Plan{
 		Config: c.config,
 		Vars:   c.variables,
-		State:  c.state,
+		State:  priorState,
 	}
-	err = g.Walk(c.planWalkFn(p, opts))
+	diags := diagsFromErr(g.Walk(c.planWalkFn(p, opts)))
 
 	// Update the diff so that our context is up-to-date
 	c.diff = p.Diff
 
-	return p, err
+	return p, diags
 }
 
 // Refresh goes through all the resources in the state and refreshes them
@@ -159,39 +472,51 @@ func (c *Context) Plan(opts *PlanOpts) (*Plan, error) {
 //
 // Even in the case an error is returned, the state will be returned and
 // will potentially be partially updated.
-func (c *Context) Refresh() (*State, error) {
+func (c *Context) Refresh() (*State, tfdiags.Diagnostics) {
 	v := c.acquireRun()
 	defer c.releaseRun(v)
 
+	c.sl.RLock()
+	priorState := c.state
+	c.sl.RUnlock()
+
 	g, err := Graph(&GraphOpts{
-		Config:    c.config,
-		Providers: c.providers,
-		State:     c.state,
+		Config:       c.config,
+		Module:       c.module,
+		Providers:    c.providers,
+		Provisioners: c.provisioners,
+		State:        priorState,
 	})
 	if err != nil {
-		return c.state, err
+		return priorState, diagsFromErr(err)
 	}
 
-	s := new(State)
-	s.init()
-	err = g.Walk(c.refreshWalkFn(s))
-
-	// Update our state
+	// Deep-copy the prior state so it becomes the authoritative,
+	// in-progress result, same as Apply.
+	c.sl.Lock()
+	s := c.state.deepcopy()
+	if s == nil {
+		s = new(State)
+		s.init()
+	}
 	c.state = s
+	c.sl.Unlock()
 
-	return s, err
+	diags := diagsFromErr(g.Walk(c.refreshWalkFn()))
+
+	return c.state, diags
 }
 
 // Stop stops the running task.
 //
 // Stop will block until the task completes.
 func (c *Context) Stop() {
-	c.l.Lock()
-	ch := c.runCh
+	c.run.l.Lock()
+	ch := c.run.runCh
 
 	// If we aren't running, then just return
 	if ch == nil {
-		c.l.Unlock()
+		c.run.l.Unlock()
 		return
 	}
 
@@ -199,66 +524,115 @@ func (c *Context) Stop() {
 	c.sh.Stop()
 
 	// Wait for us to stop
-	c.l.Unlock()
+	c.run.l.Unlock()
 	<-ch
 }
 
-// Validate validates the configuration and returns any warnings or errors.
-func (c *Context) Validate() ([]string, []error) {
-	var rerr *multierror.Error
+// Validate validates the configuration and returns any warnings or
+// errors as Diagnostics. Use Diagnostics.Legacy if a caller still needs
+// the older ([]string, []error) shape.
+func (c *Context) Validate() tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
 
 	// Validate the configuration itself
 	if err := c.config.Validate(); err != nil {
-		rerr = multierror.ErrorAppend(rerr, err)
+		diags = diags.Append(tfdiags.Diagnostic{
+			Severity: tfdiags.Error,
+			Summary:  err.Error(),
+		})
 	}
 
 	// Validate the user variables
-	if errs := smcUserVariables(c.config, c.variables); len(errs) > 0 {
-		rerr = multierror.ErrorAppend(rerr, errs...)
+	for _, err := range smcUserVariables(c.config, c.variables) {
+		diags = diags.Append(tfdiags.Diagnostic{
+			Severity: tfdiags.Error,
+			Summary:  err.Error(),
+		})
 	}
 
+	// Validate that every module block's inputs line up with variables
+	// the called module actually declares
+	diags = diags.Append(c.validateModules()...)
+
 	// Validate the graph
 	g, err := c.graph()
 	if err != nil {
-		rerr = multierror.ErrorAppend(rerr, fmt.Errorf(
-			"Error creating graph: %s", err))
+		diags = diags.Append(tfdiags.Diagnostic{
+			Severity: tfdiags.Error,
+			Summary:  fmt.Sprintf("Error creating graph: %s", err),
+		})
 	}
 
 	// Walk the graph and validate all the configs
-	var warns []string
-	var errs []error
-	err = g.Walk(c.validateWalkFn(&warns, &errs))
-	if err != nil {
-		rerr = multierror.ErrorAppend(rerr, fmt.Errorf(
-			"Error validating resources in graph: %s", err))
-	}
-	if len(errs) > 0 {
-		rerr = multierror.ErrorAppend(rerr, errs...)
-	}
-
-	errs = nil
-	if rerr != nil && len(rerr.Errors) > 0 {
-		errs = rerr.Errors
+	if err := g.Walk(c.validateWalkFn(&diags)); err != nil {
+		diags = diags.Append(tfdiags.Diagnostic{
+			Severity: tfdiags.Error,
+			Summary:  fmt.Sprintf("Error validating resources in graph: %s", err),
+		})
 	}
 
-	return warns, errs
+	return diags
 }
 
-// computeVars takes the State and given RawConfig and processes all
-// the variables. This dynamically discovers the attributes instead of
-// using a static map[string]string that the genericWalkFn uses.
-func (c *Context) computeVars(s *State, raw *config.RawConfig) error {
-	// If there are on variables, then we're done
+// computeVars takes the given RawConfig and resolves all of its
+// variables against the given State snapshot and the context's user
+// variables. This is called on demand at the point of interpolation for
+// each node (and for outputs), rather than threading an accumulated
+// map[string]string through the graph walk, so a node always observes
+// the most up to date attributes of any resource that has already been
+// applied.
+//
+// counts is used to resolve aggregate variables such as
+// "aws_instance.foo.*.id", and may be nil if raw cannot contain one
+// (for example, when computing outputs after the walk has completed).
+//
+// Resource variables are resolved against the resources belonging to
+// c's own module (c.path), so a RawConfig belonging to a child module's
+// resource is always resolved against that module's resources, never
+// the root's. A "module.<name>.<output>" variable is resolved instead
+// against the ModuleState of the named child directly beneath c.path.
+func (c *Context) computeVars(
+	s *State, counts map[string]int, raw *config.RawConfig) error {
+	// If there are no variables, then we're done
 	if len(raw.Variables) == 0 {
 		return nil
 	}
 
+	resources := c.resourcesIn(s)
+
 	// Go through each variable and find it
 	vs := make(map[string]string)
 	for n, rawV := range raw.Variables {
 		switch v := rawV.(type) {
 		case *config.ResourceVariable:
-			r, ok := s.Resources[v.ResourceId()]
+			idx := strings.Index(v.Field, ".")
+			if idx != -1 && v.Field[:idx] == "*" {
+				// Aggregate variable, e.g. "aws_instance.foo.*.id".
+				// Not pre-computed since the fanout would be expensive;
+				// resolved here directly against the state snapshot.
+				field := v.Field[idx+1:]
+				key := fmt.Sprintf("%s.%s", v.Type, v.Name)
+				count, ok := counts[key]
+				if !ok {
+					return fmt.Errorf(
+						"non-existent resource variable access: %s", key)
+				}
+
+				var values []string
+				for i := 0; i < count; i++ {
+					id := fmt.Sprintf("%s.%s.%d", v.Type, v.Name, i)
+					if r, ok := resources[id]; ok {
+						if attr, ok := r.Attributes[field]; ok {
+							values = append(values, attr)
+						}
+					}
+				}
+
+				vs[n] = strings.Join(values, ",")
+				continue
+			}
+
+			r, ok := resources[v.ResourceId()]
 			if !ok {
 				return fmt.Errorf(
 					"Resource '%s' not found for variable '%s'",
@@ -277,6 +651,23 @@ func (c *Context) computeVars(s *State, raw *config.RawConfig) error {
 			}
 
 			vs[n] = attr
+		case *config.ModuleVariable:
+			modPath := append(append([]string(nil), c.path...), v.Name)
+			ms := s.ModuleByPath(modPath)
+			if ms == nil {
+				return fmt.Errorf(
+					"Module '%s' not found for variable '%s'",
+					v.Name, v.FullKey())
+			}
+
+			val, ok := ms.Outputs[v.Field]
+			if !ok {
+				return fmt.Errorf(
+					"Module '%s' has no output '%s' for variable '%s'",
+					v.Name, v.Field, v.FullKey())
+			}
+
+			vs[n] = val
 		case *config.UserVariable:
 			vs[n] = c.variables[v.Name]
 		}
@@ -286,58 +677,209 @@ func (c *Context) computeVars(s *State, raw *config.RawConfig) error {
 	return raw.Interpolate(vs)
 }
 
+// resourcesIn returns the map of ResourceState that resource variables
+// interpolated while c is scoped to c.path should be resolved against:
+// the root s.Resources for the root module, or the Resources of the
+// matching entry in s.Modules for a descendant.
+func (c *Context) resourcesIn(s *State) map[string]*ResourceState {
+	if len(c.path) == 0 {
+		return s.Resources
+	}
+
+	if ms := s.ModuleByPath(c.path); ms != nil {
+		return ms.Resources
+	}
+
+	return nil
+}
+
+// moduleResourceStore is the write-side counterpart to resourcesIn: it
+// returns the map that a resource with the given id, encountered while
+// walking c's graph, should be written to in s, along with its local
+// key in that map. id is local to c's own module (c.path) and may carry
+// its own "module." prefix if it in turn belongs to a descendant of
+// that module, so the two are combined into the absolute path used to
+// address s.Modules.
+func (c *Context) moduleResourceStore(s *State, id string) (map[string]*ResourceState, string) {
+	relPath, local := splitModulePath(id)
+	if len(c.path) == 0 && len(relPath) == 0 {
+		return s.Resources, local
+	}
+
+	path := append(append([]string(nil), c.path...), relPath...)
+	return s.moduleState(path).Resources, local
+}
+
+// diagsFromErr lifts a plain error returned by a graph walk into
+// Diagnostics, expanding a *multierror.Error into one Diagnostic per
+// underlying error so each is reported individually.
+func diagsFromErr(err error) tfdiags.Diagnostics {
+	if err == nil {
+		return nil
+	}
+
+	if merr, ok := err.(*multierror.Error); ok {
+		var diags tfdiags.Diagnostics
+		for _, e := range merr.Errors {
+			diags = diags.Append(tfdiags.Diagnostic{
+				Severity: tfdiags.Error,
+				Summary:  e.Error(),
+			})
+		}
+		return diags
+	}
+
+	return tfdiags.Diagnostics{{
+		Severity: tfdiags.Error,
+		Summary:  err.Error(),
+	}}
+}
+
+// sourceRangeFor extracts raw's source position, if it tracks one, so
+// a Diagnostic can point back at the config block that produced it.
+func sourceRangeFor(raw *config.RawConfig) *tfdiags.SourceRange {
+	if raw == nil {
+		return nil
+	}
+
+	filename, line := raw.Pos()
+	if filename == "" {
+		return nil
+	}
+
+	return &tfdiags.SourceRange{Filename: filename, Line: line}
+}
+
+// resourceDiagnostics lifts a resource or provisioner Validate result
+// into Diagnostics tagged with the resource's id and source position.
+func resourceDiagnostics(id string, subject *tfdiags.SourceRange, ws []string, es []error) tfdiags.Diagnostics {
+	diags := tfdiags.FromProviderValidate(ws, es)
+	for i, d := range diags {
+		d.Summary = fmt.Sprintf("'%s': %s", id, d.Summary)
+		d.Subject = subject
+		diags[i] = d
+	}
+	return diags
+}
+
+// providerDiagnostics lifts a provider Validate result into
+// Diagnostics tagged with the provider's name and source position.
+func providerDiagnostics(name string, subject *tfdiags.SourceRange, ws []string, es []error) tfdiags.Diagnostics {
+	diags := tfdiags.FromProviderValidate(ws, es)
+	for i, d := range diags {
+		d.Summary = fmt.Sprintf("Provider '%s': %s", name, d.Summary)
+		d.Subject = subject
+		diags[i] = d
+	}
+	return diags
+}
+
+// validateModules checks that every "module" block in c.config supplies
+// only arguments the called module actually declares as variables, so
+// that a typo'd or removed input surfaces here instead of as a
+// confusing interpolation error part-way through Plan or Apply.
+func (c *Context) validateModules() tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	if c.config == nil {
+		return diags
+	}
+
+	var children map[string]*module.Tree
+	if c.module != nil {
+		children = c.module.Children()
+	}
+
+	for _, m := range c.config.Modules {
+		subject := sourceRangeFor(m.RawConfig)
+
+		child := children[m.Name]
+		if child == nil {
+			diags = diags.Append(tfdiags.Diagnostic{
+				Severity: tfdiags.Error,
+				Summary:  fmt.Sprintf("module '%s' not found", m.Name),
+				Subject:  subject,
+			})
+			continue
+		}
+
+		childConfig := child.Config()
+		if childConfig == nil {
+			continue
+		}
+
+		declared := make(map[string]bool, len(childConfig.Variables))
+		for _, v := range childConfig.Variables {
+			declared[v.Name] = true
+		}
+
+		for k := range m.RawConfig.Raw {
+			if !declared[k] {
+				diags = diags.Append(tfdiags.Diagnostic{
+					Severity: tfdiags.Error,
+					Summary: fmt.Sprintf(
+						"module '%s': '%s' is not a variable declared by the module",
+						m.Name, k),
+					Subject: subject,
+				})
+			}
+		}
+	}
+
+	return diags
+}
+
 func (c *Context) graph() (*depgraph.Graph, error) {
+	c.sl.RLock()
+	defer c.sl.RUnlock()
+
 	return Graph(&GraphOpts{
-		Config:    c.config,
-		Diff:      c.diff,
-		Providers: c.providers,
-		State:     c.state,
+		Config:       c.config,
+		Module:       c.module,
+		Diff:         c.diff,
+		Providers:    c.providers,
+		Provisioners: c.provisioners,
+		State:        c.state,
 	})
 }
 
 func (c *Context) acquireRun() chan<- struct{} {
-	c.l.Lock()
-	defer c.l.Unlock()
+	c.run.l.Lock()
+	defer c.run.l.Unlock()
 
 	// Wait for no channel to exist
-	for c.runCh != nil {
-		c.l.Unlock()
-		ch := c.runCh
+	for c.run.runCh != nil {
+		c.run.l.Unlock()
+		ch := c.run.runCh
 		<-ch
-		c.l.Lock()
+		c.run.l.Lock()
 	}
 
 	ch := make(chan struct{})
-	c.runCh = ch
+	c.run.runCh = ch
 	return ch
 }
 
 func (c *Context) releaseRun(ch chan<- struct{}) {
-	c.l.Lock()
-	defer c.l.Unlock()
+	c.run.l.Lock()
+	defer c.run.l.Unlock()
 
 	close(ch)
-	c.runCh = nil
+	c.run.runCh = nil
 	c.sh.Reset()
 }
 
-func (c *Context) applyWalkFn(result *State) depgraph.WalkFunc {
-	var l sync.Mutex
-
-	// Initialize the result
-	result.init()
-
-	cb := func(r *Resource) (map[string]string, error) {
+func (c *Context) applyWalkFn() depgraph.WalkFunc {
+	cb := func(r *Resource) error {
 		diff := r.Diff
 		if diff.Empty() {
-			return r.Vars(), nil
+			return nil
 		}
 
 		if !diff.Destroy {
 			var err error
 			diff, err = r.Provider.Diff(r.State, r.Config)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 
@@ -348,11 +890,16 @@ func (c *Context) applyWalkFn(result *State) depgraph.WalkFunc {
 			handleHook(h.PreApply(r.Id, r.State, diff))
 		}
 
+		// A resource is being created, rather than updated in-place, if it
+		// has no ID yet. Provisioners only ever run against newly created
+		// resources.
+		isCreate := !diff.Destroy && r.State.ID == ""
+
 		// With the completed diff, apply!
 		log.Printf("[DEBUG] %s: Executing Apply", r.Id)
 		rs, err := r.Provider.Apply(r.State, diff)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Make sure the result is instantiated
@@ -374,32 +921,72 @@ func (c *Context) applyWalkFn(result *State) depgraph.WalkFunc {
 			}
 		}
 
-		// Update the resulting diff
-		l.Lock()
+		// Run any provisioners declared on the resource now that it has
+		// been created. A provisioner failure taints the resource so
+		// that the next plan destroys and recreates it, rather than
+		// leaving it in an unknown, possibly half-provisioned state.
+		if isCreate && rs.ID != "" && len(r.Provisioners) > 0 {
+			if err := c.applyProvisioners(r, rs); err != nil {
+				errs = append(errs, err)
+				rs.Tainted = true
+			}
+		}
+
+		// Update the state for the resource itself, both the live,
+		// in-progress context state and the copy the provider callback
+		// sees on any later retry. r.Id carries a "module.<name>."
+		// prefix for any resource belonging to a descendant module, so
+		// moduleResourceStore routes the write to that module's own
+		// Resources map rather than the root's.
+		c.sl.Lock()
+		store, local := c.moduleResourceStore(c.state, r.Id)
 		if rs.ID == "" {
-			delete(result.Resources, r.Id)
+			delete(store, local)
 		} else {
-			result.Resources[r.Id] = rs
+			store[local] = rs
 		}
-		l.Unlock()
+		c.sl.Unlock()
 
-		// Update the state for the resource itself
 		r.State = rs
 
 		for _, h := range c.hooks {
 			handleHook(h.PostApply(r.Id, r.State))
 		}
 
-		// Determine the new state and update variables
-		err = nil
 		if len(errs) > 0 {
-			err = &multierror.Error{Errors: errs}
+			return &multierror.Error{Errors: errs}
 		}
 
-		return r.Vars(), err
+		return nil
 	}
 
-	return c.genericWalkFn(c.variables, cb)
+	return c.genericWalkFn(cb)
+}
+
+// applyProvisioners runs the resource's provisioners, in the order they
+// were declared, against the given freshly-created resource state. The
+// first provisioner to fail halts the remaining ones and its error is
+// returned.
+func (c *Context) applyProvisioners(r *Resource, rs *ResourceState) error {
+	for _, p := range r.Provisioners {
+		rc := NewResourceConfig(p.Config)
+
+		for _, h := range c.hooks {
+			handleHook(h.PreProvision(r.Id, p.Type))
+		}
+
+		log.Printf("[DEBUG] %s: Executing provisioner %s", r.Id, p.Type)
+		if err := p.Provisioner.Apply(rs, rc); err != nil {
+			return fmt.Errorf(
+				"%s: provisioner %s failed: %s", r.Id, p.Type, err)
+		}
+
+		for _, h := range c.hooks {
+			handleHook(h.PostProvision(r.Id, p.Type))
+		}
+	}
+
+	return nil
 }
 
 func (c *Context) planWalkFn(result *Plan, opts *PlanOpts) depgraph.WalkFunc {
@@ -413,7 +1000,7 @@ func (c *Context) planWalkFn(result *Plan, opts *PlanOpts) depgraph.WalkFunc {
 	// Initialize the result
 	result.init()
 
-	cb := func(r *Resource) (map[string]string, error) {
+	cb := func(r *Resource) error {
 		var diff *ResourceDiff
 
 		for _, h := range c.hooks {
@@ -439,7 +1026,7 @@ func (c *Context) planWalkFn(result *Plan, opts *PlanOpts) depgraph.WalkFunc {
 			var err error
 			diff, err = r.Provider.Diff(r.State, r.Config)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 
@@ -453,28 +1040,38 @@ func (c *Context) planWalkFn(result *Plan, opts *PlanOpts) depgraph.WalkFunc {
 			handleHook(h.PostDiff(r.Id, diff))
 		}
 
-		// Determine the new state and update variables
+		// Determine the new state
 		if !diff.Empty() {
 			r.State = r.State.MergeDiff(diff)
 		}
 
-		return r.Vars(), nil
+		// Record the post-diff state so that any resource diffed later
+		// in this same walk that references this one resolves against
+		// the up-to-date result rather than the pre-plan state.
+		c.sl.Lock()
+		store, local := c.moduleResourceStore(c.state, r.Id)
+		if r.State == nil || r.State.ID == "" {
+			delete(store, local)
+		} else {
+			store[local] = r.State
+		}
+		c.sl.Unlock()
+
+		return nil
 	}
 
-	return c.genericWalkFn(c.variables, cb)
+	return c.genericWalkFn(cb)
 }
 
-func (c *Context) refreshWalkFn(result *State) depgraph.WalkFunc {
-	var l sync.Mutex
-
-	cb := func(r *Resource) (map[string]string, error) {
+func (c *Context) refreshWalkFn() depgraph.WalkFunc {
+	cb := func(r *Resource) error {
 		for _, h := range c.hooks {
 			handleHook(h.PreRefresh(r.Id, r.State))
 		}
 
 		rs, err := r.Provider.Refresh(r.State)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if rs == nil {
 			rs = new(ResourceState)
@@ -483,21 +1080,22 @@ func (c *Context) refreshWalkFn(result *State) depgraph.WalkFunc {
 		// Fix the type to be the type we have
 		rs.Type = r.State.Type
 
-		l.Lock()
-		result.Resources[r.Id] = rs
-		l.Unlock()
+		c.sl.Lock()
+		store, local := c.moduleResourceStore(c.state, r.Id)
+		store[local] = rs
+		c.sl.Unlock()
 
 		for _, h := range c.hooks {
 			handleHook(h.PostRefresh(r.Id, rs))
 		}
 
-		return nil, nil
+		return nil
 	}
 
-	return c.genericWalkFn(c.variables, cb)
+	return c.genericWalkFn(cb)
 }
 
-func (c *Context) validateWalkFn(rws *[]string, res *[]error) depgraph.WalkFunc {
+func (c *Context) validateWalkFn(diags *tfdiags.Diagnostics) depgraph.WalkFunc {
 	return func(n *depgraph.Noun) error {
 		// If it is the root node, ignore
 		if n.Name == GraphRootNode {
@@ -515,37 +1113,34 @@ func (c *Context) validateWalkFn(rws *[]string, res *[]error) depgraph.WalkFunc
 				return nil
 			}
 
+			var subject *tfdiags.SourceRange
+			if rn.Config != nil {
+				subject = sourceRangeFor(rn.Config.RawConfig)
+			}
+
 			log.Printf("[INFO] Validating resource: %s", rn.Resource.Id)
 			ws, es := rn.Resource.Provider.ValidateResource(
 				rn.Type, rn.Resource.Config)
-			for i, w := range ws {
-				ws[i] = fmt.Sprintf("'%s' warning: %s", rn.Resource.Id, w)
-			}
-			for i, e := range es {
-				es[i] = fmt.Errorf("'%s' error: %s", rn.Resource.Id, e)
-			}
+			*diags = diags.Append(resourceDiagnostics(rn.Resource.Id, subject, ws, es)...)
 
-			*rws = append(*rws, ws...)
-			*res = append(*res, es...)
+			for _, p := range rn.Resource.Provisioners {
+				log.Printf("[INFO] Validating provisioner: %s", p.Type)
+				rc := NewResourceConfig(p.Config)
+				ws, es := p.Provisioner.Validate(rc)
+				*diags = diags.Append(resourceDiagnostics(rn.Resource.Id, subject, ws, es)...)
+			}
 		case *GraphNodeResourceProvider:
 			if rn.Config == nil {
 				return nil
 			}
 
+			subject := sourceRangeFor(rn.Config.RawConfig)
 			rc := NewResourceConfig(rn.Config.RawConfig)
 
 			for k, p := range rn.Providers {
 				log.Printf("[INFO] Validating provider: %s", k)
 				ws, es := p.Validate(rc)
-				for i, w := range ws {
-					ws[i] = fmt.Sprintf("Provider '%s' warning: %s", k, w)
-				}
-				for i, e := range es {
-					es[i] = fmt.Errorf("Provider '%s' error: %s", k, e)
-				}
-
-				*rws = append(*rws, ws...)
-				*res = append(*res, es...)
+				*diags = diags.Append(providerDiagnostics(k, subject, ws, es)...)
 			}
 		}
 
@@ -553,18 +1148,12 @@ func (c *Context) validateWalkFn(rws *[]string, res *[]error) depgraph.WalkFunc
 	}
 }
 
-func (c *Context) genericWalkFn(
-	invars map[string]string,
-	cb genericWalkFunc) depgraph.WalkFunc {
-	var l sync.RWMutex
-
-	// Initialize the variables for application
-	vars := make(map[string]string)
-	for k, v := range invars {
-		vars[fmt.Sprintf("var.%s", k)] = v
-	}
-
-	// This will keep track of the counts of multi-count resources
+func (c *Context) genericWalkFn(cb genericWalkFunc) depgraph.WalkFunc {
+	// This will keep track of the counts of multi-count resources,
+	// recorded as GraphNodeResourceMeta nodes are visited, so that
+	// aggregate variable lookups later in the walk know how far to fan
+	// out.
+	var cl sync.RWMutex
 	counts := make(map[string]int)
 
 	// This will keep track of whether we're stopped or not
@@ -581,25 +1170,22 @@ func (c *Context) genericWalkFn(
 			return nil
 		}
 
-		// Calculate any aggregate interpolated variables if we have to.
-		// Aggregate variables (such as "test_instance.foo.*.id") are not
-		// pre-computed since the fanout would be expensive. We calculate
-		// them on-demand here.
-		computeAggregateVars(&l, n, counts, vars)
-
 		switch m := n.Meta.(type) {
 		case *GraphNodeResource:
 		case *GraphNodeResourceMeta:
 			// Record the count and then just ignore
-			l.Lock()
+			cl.Lock()
 			counts[m.ID] = m.Count
-			l.Unlock()
+			cl.Unlock()
 			return nil
 		case *GraphNodeResourceProvider:
 			var rc *ResourceConfig
 			if m.Config != nil {
-				if err := m.Config.RawConfig.Interpolate(vars); err != nil {
-					panic(err)
+				cl.RLock()
+				err := c.computeVarsLocked(counts, m.Config.RawConfig)
+				cl.RUnlock()
+				if err != nil {
+					return err
 				}
 				rc = NewResourceConfig(m.Config.RawConfig)
 			}
@@ -619,16 +1205,33 @@ func (c *Context) genericWalkFn(
 
 		rn := n.Meta.(*GraphNodeResource)
 
-		l.RLock()
-		if len(vars) > 0 && rn.Config != nil {
-			if err := rn.Config.RawConfig.Interpolate(vars); err != nil {
+		// A resource in a descendant module carries that module's
+		// "module." prefix in its id; resolve its references against
+		// that module's own resources and child modules, not c's.
+		vc := c
+		if relPath, _ := splitModulePath(rn.Resource.Id); len(relPath) > 0 {
+			scoped := *c
+			scoped.path = append(append([]string(nil), c.path...), relPath...)
+			vc = &scoped
+		}
+
+		cl.RLock()
+		if rn.Config != nil {
+			if err := vc.computeVarsLocked(counts, rn.Config.RawConfig); err != nil {
+				cl.RUnlock()
 				panic(fmt.Sprintf("Interpolate error: %s", err))
 			}
 
 			// Force the config to be set later
 			rn.Resource.Config = nil
 		}
-		l.RUnlock()
+		for _, p := range rn.Resource.Provisioners {
+			if err := vc.computeVarsLocked(counts, p.Config); err != nil {
+				cl.RUnlock()
+				panic(fmt.Sprintf("Interpolate error: %s", err))
+			}
+		}
+		cl.RUnlock()
 
 		// Make sure that at least some resource configuration is set
 		if !rn.Orphan {
@@ -654,89 +1257,28 @@ func (c *Context) genericWalkFn(
 			}
 		}()
 
-		// Call the callack
-		log.Printf("[INFO] Walking: %s", rn.Resource.Id)
-		newVars, err := cb(rn.Resource)
-		if err != nil {
-			return err
-		}
-
-		if len(newVars) > 0 {
-			// Acquire a lock since this function is called in parallel
-			l.Lock()
-			defer l.Unlock()
-
-			// Update variables
-			for k, v := range newVars {
-				vars[k] = v
-			}
+		// Acquire a slot in the parallelism semaphore before invoking the
+		// callback, and make sure it is released no matter how the
+		// callback returns, including via the HookActionHalt panic
+		// recovered above. A nil semaphore means parallelism is unbounded.
+		if c.parallelSem != nil {
+			c.parallelSem.Acquire()
+			defer c.parallelSem.Release()
 		}
 
-		return nil
+		// Call the callback
+		log.Printf("[INFO] Walking: %s", rn.Resource.Id)
+		return cb(rn.Resource)
 	}
 }
 
-func computeAggregateVars(
-	l *sync.RWMutex,
-	n *depgraph.Noun,
-	cs map[string]int,
-	vs map[string]string) {
-	var ivars map[string]config.InterpolatedVariable
-	switch m := n.Meta.(type) {
-	case *GraphNodeResource:
-		if m.Config != nil {
-			ivars = m.Config.RawConfig.Variables
-		}
-	case *GraphNodeResourceProvider:
-		if m.Config != nil {
-			ivars = m.Config.RawConfig.Variables
-		}
-	}
-	if len(ivars) == 0 {
-		return
-	}
+// computeVarsLocked resolves raw's variables against the context's
+// current in-progress state. c.sl is acquired for the duration of the
+// read so that the node always sees a consistent view of whatever has
+// been applied or refreshed so far.
+func (c *Context) computeVarsLocked(counts map[string]int, raw *config.RawConfig) error {
+	c.sl.RLock()
+	defer c.sl.RUnlock()
 
-	for _, v := range ivars {
-		rv, ok := v.(*config.ResourceVariable)
-		if !ok {
-			continue
-		}
-
-		idx := strings.Index(rv.Field, ".")
-		if idx == -1 {
-			// It isn't an aggregated var
-			continue
-		}
-		if rv.Field[:idx] != "*" {
-			// It isn't an aggregated var
-			continue
-		}
-		field := rv.Field[idx+1:]
-
-		// Get the meta node so that we can determine the count
-		key := fmt.Sprintf("%s.%s", rv.Type, rv.Name)
-		l.RLock()
-		count, ok := cs[key]
-		l.RUnlock()
-		if !ok {
-			// This should never happen due to semantic checks
-			panic(fmt.Sprintf(
-				"non-existent resource variable access: %s\n\n%#v", key, rv))
-		}
-
-		var values []string
-		for i := 0; i < count; i++ {
-			key := fmt.Sprintf(
-				"%s.%s.%d.%s",
-				rv.Type,
-				rv.Name,
-				i,
-				field)
-			if v, ok := vs[key]; ok {
-				values = append(values, v)
-			}
-		}
-
-		vs[rv.FullKey()] = strings.Join(values, ",")
-	}
+	return c.computeVars(c.state, counts, raw)
 }
@@ -0,0 +1,57 @@
+package terraform
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+)
+
+// TestContext_computeVars_forwardReference exercises the scenario the
+// map-threading model used to handle by feeding a node's computed Vars
+// forward to the next: a RawConfig referencing a resource that only
+// exists in the State because an earlier step of the same walk (Plan's
+// diff, in production) has already written it there.
+func TestContext_computeVars_forwardReference(t *testing.T) {
+	c := &Context{variables: map[string]string{}}
+
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"value": "${aws_instance.a.id}",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := &State{
+		Resources: map[string]*ResourceState{
+			"aws_instance.a": {Attributes: map[string]string{"id": "a-id"}},
+		},
+	}
+
+	if err := c.computeVars(s, nil, raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := raw.Config()["value"]; got != "a-id" {
+		t.Fatalf("expected %q, got %#v", "a-id", got)
+	}
+}
+
+// TestContext_computeVars_resourceNotYetInState is the failure mode
+// the forward-reference support above exists to avoid: a reference to
+// a resource that genuinely has not been processed yet.
+func TestContext_computeVars_resourceNotYetInState(t *testing.T) {
+	c := &Context{variables: map[string]string{}}
+
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"value": "${aws_instance.a.id}",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := &State{Resources: map[string]*ResourceState{}}
+
+	if err := c.computeVars(s, nil, raw); err == nil {
+		t.Fatal("expected an error for a resource not yet present in state")
+	}
+}
@@ -0,0 +1,79 @@
+package terraform
+
+import "strings"
+
+// ModuleState holds the resources and outputs that belong to a single
+// module instance within a State. The root module has no ModuleState: its
+// resources and outputs are held directly on the State's Resources and
+// Outputs fields. Every other module is keyed by the
+// full path of module names from the root, e.g. []string{"vpc"}, or
+// []string{"vpc", "subnets"} for a module nested two levels deep.
+type ModuleState struct {
+	Path      []string
+	Resources map[string]*ResourceState
+	Outputs   map[string]string
+}
+
+func (m *ModuleState) init() {
+	if m.Resources == nil {
+		m.Resources = make(map[string]*ResourceState)
+	}
+	if m.Outputs == nil {
+		m.Outputs = make(map[string]string)
+	}
+}
+
+// modulePathKey joins a module path into the dotted key used both for
+// resource id prefixes ("module.vpc.aws_instance.web") and for matching
+// a ModuleState to the path it was recorded under.
+func modulePathKey(path []string) string {
+	return strings.Join(path, ".")
+}
+
+// splitModulePath splits a resource id into the module path it belongs
+// to and its id local to that module. An id with no "module." prefix,
+// such as "aws_instance.web", belongs to the root module and is
+// returned unchanged with a nil path.
+func splitModulePath(id string) (path []string, local string) {
+	parts := strings.Split(id, ".")
+
+	i := 0
+	for i+1 < len(parts) && parts[i] == "module" {
+		path = append(path, parts[i+1])
+		i += 2
+	}
+
+	return path, strings.Join(parts[i:], ".")
+}
+
+// ModuleByPath returns the ModuleState recorded for the given path, or
+// nil if the state has no entry for it yet. A nil or empty path, the
+// root module, always returns nil: the root module is held directly on
+// the State's Resources and Outputs fields rather than in Modules.
+func (s *State) ModuleByPath(path []string) *ModuleState {
+	if s == nil || len(path) == 0 {
+		return nil
+	}
+
+	key := modulePathKey(path)
+	for _, m := range s.Modules {
+		if modulePathKey(m.Path) == key {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// moduleState returns the ModuleState for path, creating and appending
+// an empty one if none exists yet.
+func (s *State) moduleState(path []string) *ModuleState {
+	if m := s.ModuleByPath(path); m != nil {
+		return m
+	}
+
+	m := &ModuleState{Path: append([]string(nil), path...)}
+	m.init()
+	s.Modules = append(s.Modules, m)
+	return m
+}
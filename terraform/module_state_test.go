@@ -0,0 +1,113 @@
+package terraform
+
+import "testing"
+
+func TestSplitModulePath(t *testing.T) {
+	cases := []struct {
+		id        string
+		wantPath  []string
+		wantLocal string
+	}{
+		{"aws_instance.foo", nil, "aws_instance.foo"},
+		{"module.vpc.aws_instance.foo", []string{"vpc"}, "aws_instance.foo"},
+		{"module.vpc.module.subnets.aws_instance.foo", []string{"vpc", "subnets"}, "aws_instance.foo"},
+	}
+
+	for _, tc := range cases {
+		path, local := splitModulePath(tc.id)
+		if modulePathKey(path) != modulePathKey(tc.wantPath) {
+			t.Errorf("%s: got path %v, want %v", tc.id, path, tc.wantPath)
+		}
+		if local != tc.wantLocal {
+			t.Errorf("%s: got local %q, want %q", tc.id, local, tc.wantLocal)
+		}
+	}
+}
+
+func TestState_ModuleByPath(t *testing.T) {
+	s := new(State)
+	s.init()
+
+	if s.ModuleByPath([]string{"vpc"}) != nil {
+		t.Fatal("expected no ModuleState before one is created")
+	}
+
+	ms := s.moduleState([]string{"vpc"})
+	ms.Resources["aws_instance.a"] = &ResourceState{Attributes: map[string]string{"id": "vpc-id"}}
+
+	got := s.ModuleByPath([]string{"vpc"})
+	if got == nil {
+		t.Fatal("expected to find the ModuleState just created")
+	}
+	if got.Resources["aws_instance.a"].Attributes["id"] != "vpc-id" {
+		t.Fatal("ModuleByPath returned a different ModuleState than the one populated")
+	}
+
+	// moduleState is idempotent: calling it again for the same path
+	// must return the existing entry rather than appending a duplicate.
+	s.moduleState([]string{"vpc"})
+	if len(s.Modules) != 1 {
+		t.Fatalf("expected exactly 1 module state, got %d", len(s.Modules))
+	}
+}
+
+// TestContext_resourcesIn_module confirms that a Context scoped to a
+// descendant module (as returned by Module) resolves resource
+// references against that module's own ModuleState rather than the
+// root's, so a resource can reference a sibling within the same
+// module.
+func TestContext_resourcesIn_module(t *testing.T) {
+	c := &Context{path: []string{"vpc"}}
+
+	s := &State{
+		Resources: map[string]*ResourceState{
+			"aws_instance.root": {Attributes: map[string]string{"id": "root-id"}},
+		},
+		Modules: []*ModuleState{
+			{
+				Path: []string{"vpc"},
+				Resources: map[string]*ResourceState{
+					"aws_instance.a": {Attributes: map[string]string{"id": "vpc-id"}},
+				},
+			},
+		},
+	}
+
+	resources := c.resourcesIn(s)
+	if _, ok := resources["aws_instance.root"]; ok {
+		t.Fatal("module-scoped Context should not see the root module's resources")
+	}
+
+	r, ok := resources["aws_instance.a"]
+	if !ok {
+		t.Fatal("expected to find aws_instance.a in the vpc module's resources")
+	}
+	if r.Attributes["id"] != "vpc-id" {
+		t.Fatalf("expected vpc-id, got %q", r.Attributes["id"])
+	}
+}
+
+// TestContext_moduleResourceStore_scopesWrites confirms that writes
+// made while walking a module-scoped Context's own graph land in that
+// module's ModuleState, combining the Context's path with any further
+// "module." prefix on the id, rather than in the root State.Resources.
+func TestContext_moduleResourceStore_scopesWrites(t *testing.T) {
+	c := &Context{path: []string{"vpc"}}
+	s := new(State)
+	s.init()
+
+	store, local := c.moduleResourceStore(s, "aws_instance.a")
+	if local != "aws_instance.a" {
+		t.Fatalf("expected local id %q, got %q", "aws_instance.a", local)
+	}
+
+	store["aws_instance.a"] = &ResourceState{Attributes: map[string]string{"id": "vpc-id"}}
+
+	ms := s.ModuleByPath([]string{"vpc"})
+	if ms == nil {
+		t.Fatal("expected a ModuleState to be created for path [vpc]")
+	}
+	if ms.Resources["aws_instance.a"].Attributes["id"] != "vpc-id" {
+		t.Fatal("write did not land in the vpc module's ResourceState")
+	}
+}
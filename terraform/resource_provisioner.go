@@ -0,0 +1,42 @@
+package terraform
+
+import "github.com/hashicorp/terraform/config"
+
+// ResourceProvisioner is the interface that must be implemented by any
+// resource provisioner: the thing that handles post-creation processing
+// of a resource, such as running remote commands or copying files.
+type ResourceProvisioner interface {
+	// Validate is called once at the beginning with the raw
+	// configuration (no interpolation done) and can return a list of
+	// warnings and/or errors.
+	Validate(*ResourceConfig) ([]string, []error)
+
+	// Apply runs the provisioner against the resource's (already
+	// interpolated) configuration. This is run after the resource itself
+	// has been successfully created.
+	Apply(*ResourceState, *ResourceConfig) error
+
+	// Stop is called to ask the provisioner to halt any in-progress work
+	// as quickly as possible, for example in response to SIGINT.
+	Stop() error
+}
+
+// ResourceProvisionerFactory is a function type that creates a new
+// instance of a resource provisioner.
+type ResourceProvisionerFactory func() (ResourceProvisioner, error)
+
+// ResourceProvisionerConfig represents a single configured `provisioner`
+// block attached to a resource in configuration. Graph() attaches these,
+// in declared order, to the Resource's Provisioners field.
+type ResourceProvisionerConfig struct {
+	// Type is the provisioner type, such as "remote-exec".
+	Type string
+
+	// Provisioner is the instantiated provisioner for Type.
+	Provisioner ResourceProvisioner
+
+	// Config is the raw provisioner configuration, interpolated in
+	// place against the same variables as the owning resource before
+	// Apply is called.
+	Config *config.RawConfig
+}
@@ -0,0 +1,87 @@
+package terraform
+
+import (
+	"errors"
+	"testing"
+)
+
+var errFakeProvisionerFailure = errors.New("provisioner exploded")
+
+// testProvisioner is a fake ResourceProvisioner whose Apply can be told
+// to fail, and which records whether it was ever called.
+type testProvisioner struct {
+	applyErr error
+	applied  bool
+}
+
+func (p *testProvisioner) Validate(*ResourceConfig) ([]string, []error) { return nil, nil }
+
+func (p *testProvisioner) Apply(*ResourceState, *ResourceConfig) error {
+	p.applied = true
+	return p.applyErr
+}
+
+func (p *testProvisioner) Stop() error { return nil }
+
+func TestContext_applyProvisioners_success(t *testing.T) {
+	p := &testProvisioner{}
+	c := &Context{}
+	r := &Resource{
+		Id: "aws_instance.foo",
+		Provisioners: []*ResourceProvisionerConfig{
+			{Type: "test", Provisioner: p},
+		},
+	}
+
+	if err := c.applyProvisioners(r, new(ResourceState)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.applied {
+		t.Fatal("expected the provisioner to have been applied")
+	}
+}
+
+func TestContext_applyProvisioners_failureIsWrapped(t *testing.T) {
+	p := &testProvisioner{applyErr: errFakeProvisionerFailure}
+	c := &Context{}
+	r := &Resource{
+		Id: "aws_instance.foo",
+		Provisioners: []*ResourceProvisionerConfig{
+			{Type: "test", Provisioner: p},
+		},
+	}
+
+	err := c.applyProvisioners(r, new(ResourceState))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := "aws_instance.foo: provisioner test failed: " + errFakeProvisionerFailure.Error()
+	if err.Error() != want {
+		t.Fatalf("got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestContext_applyProvisioners_haltsOnFirstFailure(t *testing.T) {
+	first := &testProvisioner{applyErr: errFakeProvisionerFailure}
+	second := &testProvisioner{}
+	c := &Context{}
+	r := &Resource{
+		Id: "aws_instance.foo",
+		Provisioners: []*ResourceProvisionerConfig{
+			{Type: "first", Provisioner: first},
+			{Type: "second", Provisioner: second},
+		},
+	}
+
+	if err := c.applyProvisioners(r, new(ResourceState)); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !first.applied {
+		t.Fatal("expected the first provisioner to have been applied")
+	}
+	if second.applied {
+		t.Fatal("the second provisioner should never run once the first has failed")
+	}
+}
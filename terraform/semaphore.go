@@ -0,0 +1,38 @@
+package terraform
+
+// Semaphore is a wrapper around a channel to provide a counting semaphore.
+type Semaphore chan struct{}
+
+// NewSemaphore creates a new semaphore with the given number of slots.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		panic("semaphore n <= 0")
+	}
+
+	return make(Semaphore, n)
+}
+
+// Acquire blocks until a slot is available, then takes it.
+func (s Semaphore) Acquire() {
+	s <- struct{}{}
+}
+
+// TryAcquire does a non-blocking acquire of a slot, returning true
+// if it was able to or false if it could not.
+func (s Semaphore) TryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release releases a slot that was previously acquired.
+func (s Semaphore) Release() {
+	select {
+	case <-s:
+	default:
+		panic("release without an acquire")
+	}
+}
@@ -0,0 +1,40 @@
+package terraform
+
+import "testing"
+
+func TestNewSemaphore_panicsOnNonPositive(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for n <= 0")
+		}
+	}()
+
+	NewSemaphore(0)
+}
+
+func TestSemaphore_acquireRelease(t *testing.T) {
+	s := NewSemaphore(1)
+
+	if !s.TryAcquire() {
+		t.Fatal("expected first TryAcquire to succeed")
+	}
+	if s.TryAcquire() {
+		t.Fatal("expected second TryAcquire to fail, slot already held")
+	}
+
+	s.Release()
+
+	if !s.TryAcquire() {
+		t.Fatal("expected TryAcquire to succeed after Release")
+	}
+}
+
+func TestSemaphore_releaseWithoutAcquirePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic releasing a slot that was never acquired")
+		}
+	}()
+
+	NewSemaphore(1).Release()
+}
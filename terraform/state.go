@@ -0,0 +1,68 @@
+package terraform
+
+// deepcopy returns a deep copy of the state, so that a caller holding a
+// reference to it is never affected by further in-place mutations made
+// by a Context that is still walking its graph.
+func (s *State) deepcopy() *State {
+	if s == nil {
+		return nil
+	}
+
+	n := new(State)
+	n.init()
+
+	for k, v := range s.Resources {
+		if v == nil {
+			continue
+		}
+
+		rsCopy := *v
+		if v.Attributes != nil {
+			rsCopy.Attributes = make(map[string]string, len(v.Attributes))
+			for ak, av := range v.Attributes {
+				rsCopy.Attributes[ak] = av
+			}
+		}
+
+		n.Resources[k] = &rsCopy
+	}
+
+	if s.Outputs != nil {
+		n.Outputs = make(map[string]string, len(s.Outputs))
+		for k, v := range s.Outputs {
+			n.Outputs[k] = v
+		}
+	}
+
+	if s.Modules != nil {
+		n.Modules = make([]*ModuleState, len(s.Modules))
+		for i, m := range s.Modules {
+			mCopy := &ModuleState{Path: append([]string(nil), m.Path...)}
+			mCopy.init()
+
+			for k, v := range m.Resources {
+				if v == nil {
+					continue
+				}
+
+				rsCopy := *v
+				if v.Attributes != nil {
+					rsCopy.Attributes = make(map[string]string, len(v.Attributes))
+					for ak, av := range v.Attributes {
+						rsCopy.Attributes[ak] = av
+					}
+				}
+
+				mCopy.Resources[k] = &rsCopy
+			}
+
+			for k, v := range m.Outputs {
+				mCopy.Outputs[k] = v
+			}
+
+			n.Modules[i] = mCopy
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,25 @@
+package terraform
+
+// UIInput is the interface that must be implemented to ask for input
+// from this user. This should forward the request to wherever the
+// user inputs things to ask for values.
+type UIInput interface {
+	Input(*InputOpts) (string, error)
+}
+
+// InputOpts are the options for asking for input.
+type InputOpts struct {
+	// Id is a unique ID for the question being asked that might be
+	// used for logging or to look up a prior answer.
+	Id string
+
+	// Query is a human-friendly question for inputting this value.
+	Query string
+
+	// Description is a description of the question. This should
+	// probably be short.
+	Description string
+
+	// Default will be the default value if the user just hits enter.
+	Default string
+}
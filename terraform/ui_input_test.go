@@ -0,0 +1,98 @@
+package terraform
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+)
+
+// testUIInput is a fake UIInput that returns a fixed answer and records
+// every Id it was asked for.
+type testUIInput struct {
+	answer string
+	asked  []string
+}
+
+func (i *testUIInput) Input(opts *InputOpts) (string, error) {
+	i.asked = append(i.asked, opts.Id)
+	return i.answer, nil
+}
+
+func testInputContext(uiInput UIInput, vars []*config.Variable) *Context {
+	return &Context{
+		config:    &config.Config{Variables: vars},
+		variables: make(map[string]string),
+		uiInput:   uiInput,
+		sl:        new(sync.RWMutex),
+		run:       &contextRunState{},
+		sh:        new(stopHook),
+	}
+}
+
+func TestContext_Input_asksForVariables(t *testing.T) {
+	in := &testUIInput{answer: "bar"}
+	c := testInputContext(in, []*config.Variable{
+		{Name: "foo", Description: "a var"},
+	})
+
+	if err := c.Input(InputModeVar); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(in.asked) != 1 || in.asked[0] != "var.foo" {
+		t.Fatalf("expected exactly one question for var.foo, got %v", in.asked)
+	}
+	if c.variables["foo"] != "bar" {
+		t.Fatalf("expected foo=bar, got %q", c.variables["foo"])
+	}
+}
+
+func TestContext_Input_unsetOnlySkipsAlreadySetVariables(t *testing.T) {
+	in := &testUIInput{answer: "new-value"}
+	c := testInputContext(in, []*config.Variable{
+		{Name: "already_set", Description: "set"},
+		{Name: "missing", Description: "unset"},
+	})
+	c.variables["already_set"] = "existing-value"
+
+	if err := c.Input(InputModeVar | InputModeVarUnset); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(in.asked) != 1 || in.asked[0] != "var.missing" {
+		t.Fatalf("expected only var.missing to be asked, got %v", in.asked)
+	}
+	if c.variables["already_set"] != "existing-value" {
+		t.Fatal("already-set variable should not have been overwritten")
+	}
+	if c.variables["missing"] != "new-value" {
+		t.Fatalf("expected missing=new-value, got %q", c.variables["missing"])
+	}
+}
+
+func TestContext_Input_skipsVariablesWithDefaultsAndNoDescription(t *testing.T) {
+	in := &testUIInput{answer: "should-not-be-used"}
+	c := testInputContext(in, []*config.Variable{
+		{Name: "has_default", Default: "d"},
+	})
+
+	if err := c.Input(InputModeVar); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(in.asked) != 0 {
+		t.Fatalf("expected no questions for a defaulted, undescribed variable, got %v", in.asked)
+	}
+}
+
+func TestContext_Input_nilUIInputErrorsInsteadOfPanicking(t *testing.T) {
+	c := testInputContext(nil, []*config.Variable{
+		{Name: "foo", Description: "a var"},
+	})
+
+	err := c.Input(InputModeVar)
+	if err == nil {
+		t.Fatal("expected an error when UIInput is nil, got none")
+	}
+}
@@ -0,0 +1,61 @@
+// Package tfdiags defines a unified representation of the errors and
+// warnings that Terraform operations (Validate, Plan, Apply, Refresh)
+// can produce. Unlike a plain error, a Diagnostic carries a severity,
+// a short summary suitable for a one-line message, an optional longer
+// Detail, and an optional source location so callers can render
+// pointer-style error messages back at the offending configuration.
+package tfdiags
+
+import "fmt"
+
+// Severity describes whether a Diagnostic represents a problem that
+// prevented an operation from completing (Error) or one that it
+// completed despite (Warning).
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Error:
+		return "Error"
+	case Warning:
+		return "Warning"
+	default:
+		return "Invalid"
+	}
+}
+
+// SourceRange identifies the configuration location that a Diagnostic
+// is about.
+type SourceRange struct {
+	// Filename is the name of the file the diagnostic's subject came
+	// from, as recorded in config.RawConfig.
+	Filename string
+
+	// Line is the 1-based line within Filename.
+	Line int
+}
+
+// Diagnostic is a single error or warning produced by a Terraform
+// operation.
+type Diagnostic struct {
+	Severity Severity
+	Summary  string
+	Detail   string
+	Subject  *SourceRange
+}
+
+// Error implements the error interface so that a Diagnostic (or a
+// Diagnostics slice, via Err/ErrWithWarnings) can be handed to code
+// that only knows about plain Go errors.
+func (d Diagnostic) Error() string {
+	if d.Detail == "" {
+		return d.Summary
+	}
+
+	return fmt.Sprintf("%s: %s", d.Summary, d.Detail)
+}
@@ -0,0 +1,86 @@
+package tfdiags
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diagnostics is a list of Diagnostic. The zero value is a valid,
+// empty Diagnostics ready to Append to.
+type Diagnostics []Diagnostic
+
+// Append adds the given diagnostics to the list, returning the updated
+// list. As with the builtin append, the receiver is not modified in
+// place, so callers must use the return value.
+func (d Diagnostics) Append(diags ...Diagnostic) Diagnostics {
+	return append(d, diags...)
+}
+
+// HasErrors returns true if the list contains at least one Diagnostic
+// of Error severity.
+func (d Diagnostics) HasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity == Error {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Err returns the Diagnostics as an error, or nil if it contains no
+// Error-severity diagnostics. This is the shape most callers that only
+// care about failure, not warnings, should use.
+func (d Diagnostics) Err() error {
+	if !d.HasErrors() {
+		return nil
+	}
+
+	return diagnosticsError(d)
+}
+
+// ErrWithWarnings is like Err except that it also returns a non-nil
+// error if the list is non-empty but contains only warnings, for
+// callers that want to surface warnings as failures too.
+func (d Diagnostics) ErrWithWarnings() error {
+	if len(d) == 0 {
+		return nil
+	}
+
+	return diagnosticsError(d)
+}
+
+// Legacy splits the Diagnostics back into the ([]string, []error)
+// shape used by callers that predate this package, so they don't all
+// need to be converted at once.
+func (d Diagnostics) Legacy() ([]string, []error) {
+	var warns []string
+	var errs []error
+	for _, diag := range d {
+		if diag.Severity == Warning {
+			warns = append(warns, diag.Error())
+		} else {
+			errs = append(errs, diag)
+		}
+	}
+
+	return warns, errs
+}
+
+type diagnosticsError Diagnostics
+
+func (d diagnosticsError) Error() string {
+	switch len(d) {
+	case 0:
+		return "no errors"
+	case 1:
+		return Diagnostic(d[0]).Error()
+	default:
+		points := make([]string, len(d))
+		for i, diag := range d {
+			points[i] = fmt.Sprintf("* %s", Diagnostic(diag).Error())
+		}
+
+		return fmt.Sprintf("%d problems:\n\n%s", len(d), strings.Join(points, "\n"))
+	}
+}
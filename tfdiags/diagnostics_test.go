@@ -0,0 +1,79 @@
+package tfdiags
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDiagnostics_HasErrors(t *testing.T) {
+	var diags Diagnostics
+	if diags.HasErrors() {
+		t.Fatal("empty Diagnostics should not have errors")
+	}
+
+	diags = diags.Append(Diagnostic{Severity: Warning, Summary: "uh oh"})
+	if diags.HasErrors() {
+		t.Fatal("a warning-only Diagnostics should not have errors")
+	}
+
+	diags = diags.Append(Diagnostic{Severity: Error, Summary: "boom"})
+	if !diags.HasErrors() {
+		t.Fatal("expected HasErrors once an Error-severity Diagnostic is appended")
+	}
+}
+
+func TestDiagnostics_Err(t *testing.T) {
+	var diags Diagnostics
+	if diags.Err() != nil {
+		t.Fatal("expected nil Err for empty Diagnostics")
+	}
+
+	diags = diags.Append(Diagnostic{Severity: Warning, Summary: "uh oh"})
+	if diags.Err() != nil {
+		t.Fatal("expected nil Err when only warnings are present")
+	}
+	if diags.ErrWithWarnings() == nil {
+		t.Fatal("expected non-nil ErrWithWarnings when warnings are present")
+	}
+
+	diags = diags.Append(Diagnostic{Severity: Error, Summary: "boom"})
+	if diags.Err() == nil {
+		t.Fatal("expected non-nil Err once an Error-severity Diagnostic is appended")
+	}
+}
+
+func TestDiagnostics_Legacy(t *testing.T) {
+	diags := Diagnostics{
+		{Severity: Warning, Summary: "warn 1"},
+		{Severity: Error, Summary: "err 1"},
+		{Severity: Warning, Summary: "warn 2"},
+	}
+
+	warns, errs := diags.Legacy()
+	if len(warns) != 2 {
+		t.Fatalf("expected 2 warnings, got %d", len(warns))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %d", len(errs))
+	}
+}
+
+func TestFromProviderValidate(t *testing.T) {
+	diags := FromProviderValidate(
+		[]string{"deprecated field"},
+		[]error{errors.New("required field missing")},
+	)
+
+	if len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %d", len(diags))
+	}
+	if diags[0].Severity != Warning {
+		t.Fatalf("expected first diagnostic to be a Warning, got %s", diags[0].Severity)
+	}
+	if diags[1].Severity != Error {
+		t.Fatalf("expected second diagnostic to be an Error, got %s", diags[1].Severity)
+	}
+	if !diags.HasErrors() {
+		t.Fatal("expected HasErrors to be true")
+	}
+}
@@ -0,0 +1,24 @@
+package tfdiags
+
+// FromProviderValidate lifts the conventional ([]string, []error)
+// result returned by a ResourceProvider, ResourceProvisioner, or
+// helper/schema Validate call into Diagnostics, tagging each warning
+// and error with the right Severity instead of flattening them into a
+// single bucket the way the legacy shape does.
+func FromProviderValidate(warns []string, errs []error) Diagnostics {
+	var diags Diagnostics
+	for _, w := range warns {
+		diags = diags.Append(Diagnostic{
+			Severity: Warning,
+			Summary:  w,
+		})
+	}
+	for _, e := range errs {
+		diags = diags.Append(Diagnostic{
+			Severity: Error,
+			Summary:  e.Error(),
+		})
+	}
+
+	return diags
+}